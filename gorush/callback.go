@@ -0,0 +1,193 @@
+package gorush
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	apns "github.com/sideshow/apns2"
+)
+
+// Callback lets a caller learn what happened to a queued push without
+// polling: once PushToIOSWithErrorResult/PushToAndroidWithErrorResult
+// finish retrying, gorush POSTs a signed CallbackReport to URL.
+type Callback struct {
+	URL     string            `json:"url,omitempty"`
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Secret  string            `json:"secret,omitempty"`
+}
+
+// CallbackReport is the JSON body POSTed to a Callback's URL.
+type CallbackReport struct {
+	ID       string            `json:"id,omitempty"`
+	Platform int               `json:"platform"`
+	Attempts int               `json:"attempts"`
+	Results  map[string]string `json:"results"`
+}
+
+const (
+	// callbackMaxRetry caps how many times gorush retries delivering a
+	// single callback before giving up on it.
+	callbackMaxRetry = 5
+
+	// callbackInitialBackoff is the delay before the first callback retry;
+	// it doubles after every further attempt.
+	callbackInitialBackoff = 500 * time.Millisecond
+
+	// callbackSignatureHeader carries the HMAC-SHA256 of the body, hex
+	// encoded, so receivers can verify the report came from this gorush.
+	callbackSignatureHeader = "X-Gorush-Signature"
+)
+
+type callbackJob struct {
+	callback Callback
+	report   CallbackReport
+}
+
+// callbackQueue decouples callback delivery from the push workers, so a
+// slow or unreachable webhook endpoint can't stall PushToIOS/PushToAndroid.
+var callbackQueue chan callbackJob
+
+// InitCallbackWorkers starts workerNum goroutines delivering callbacks
+// from a queue buffering up to queueNum reports.
+func InitCallbackWorkers(workerNum int64, queueNum int64) {
+	callbackQueue = make(chan callbackJob, queueNum)
+	for i := int64(0); i < workerNum; i++ {
+		go callbackWorker()
+	}
+}
+
+func callbackWorker() {
+	for job := range callbackQueue {
+		deliverCallback(job.callback, job.report)
+	}
+}
+
+// enqueueCallback schedules a delivery report for req if it carries a
+// Callback. tokens is the full set of tokens the request was sent to;
+// reasons holds the failure reason for whichever of them didn't succeed.
+func enqueueCallback(req PushNotification, tokens []string, attempts int, reasons map[string]string) {
+	if req.Callback == nil || req.Callback.URL == "" {
+		return
+	}
+
+	results := make(map[string]string, len(tokens))
+	for _, token := range tokens {
+		if reason, failed := reasons[token]; failed {
+			results[token] = reason
+		} else {
+			results[token] = "Success"
+		}
+	}
+
+	report := CallbackReport{
+		ID:       req.ApnsID,
+		Platform: req.Platform,
+		Attempts: attempts,
+		Results:  results,
+	}
+
+	select {
+	case callbackQueue <- callbackJob{callback: *req.Callback, report: report}:
+	default:
+		LogError.Error("callback queue full, dropping report for " + req.Callback.URL)
+	}
+}
+
+// iosResultsToReasons reduces the per-token APNs responses down to the
+// plain reason strings enqueueCallback expects. A token whose push failed
+// without any APNs response (a transport error) is reported as "Failed".
+func iosResultsToReasons(tokens []string, results map[string]*apns.Response) map[string]string {
+	reasons := make(map[string]string, len(results))
+	for _, token := range tokens {
+		res, ok := results[token]
+		if !ok {
+			continue
+		}
+		if res == nil {
+			reasons[token] = "Failed"
+			continue
+		}
+		reasons[token] = res.Reason
+	}
+
+	return reasons
+}
+
+// androidResultsToReasons reduces the per-token GoogleResponses down to
+// the plain reason strings enqueueCallback expects.
+func androidResultsToReasons(results map[string]*GoogleResponse) map[string]string {
+	reasons := make(map[string]string, len(results))
+	for token, res := range results {
+		reasons[token] = res.Reason
+	}
+
+	return reasons
+}
+
+// deliverCallback POSTs report to callback.URL, retrying with exponential
+// backoff up to callbackMaxRetry times.
+func deliverCallback(callback Callback, report CallbackReport) {
+	body, err := json.Marshal(report)
+	if err != nil {
+		LogError.Error("callback marshal error: " + err.Error())
+		return
+	}
+
+	backoff := callbackInitialBackoff
+
+	for attempt := 0; attempt <= callbackMaxRetry; attempt++ {
+		if postCallback(callback, body) {
+			return
+		}
+
+		if attempt == callbackMaxRetry {
+			LogError.Error("callback delivery to " + callback.URL + " gave up after " + strconv.Itoa(attempt+1) + " attempts")
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// postCallback makes a single attempt at delivering body to callback.URL,
+// signing it with an HMAC-SHA256 of Secret when one is configured.
+func postCallback(callback Callback, body []byte) bool {
+	method := callback.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	httpReq, err := http.NewRequest(method, callback.URL, bytes.NewReader(body))
+	if err != nil {
+		LogError.Error("callback request error: " + err.Error())
+		return false
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+	for k, v := range callback.Headers {
+		httpReq.Header.Set(k, v)
+	}
+
+	if callback.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(callback.Secret))
+		mac.Write(body)
+		httpReq.Header.Set(callbackSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		LogError.Error("callback delivery error: " + err.Error())
+		return false
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
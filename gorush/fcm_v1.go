@@ -0,0 +1,371 @@
+package gorush
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// fcmV1Scope is the OAuth2 scope required to call the FCM v1 send endpoint.
+const fcmV1Scope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// fcmV1MaxConcurrency bounds how many FCM v1 requests are in flight for a
+// single PushNotification at once, since v1 only accepts one token per
+// call unlike the legacy multicast GCM API.
+const fcmV1MaxConcurrency = 50
+
+// fcmV1InitialBackoff is the first retry delay for UNAVAILABLE/INTERNAL
+// responses when the server doesn't send a Retry-After header.
+const fcmV1InitialBackoff = 1 * time.Second
+
+// fcmV1TokenSource mints and refreshes the OAuth2 access token used to
+// authenticate against FCM v1 from the Android service-account key. It is
+// nil until InitFCMv1Client runs.
+var fcmV1TokenSource oauth2.TokenSource
+
+// InitFCMv1Client sets up the OAuth2 token source used by
+// PushToAndroidV1WithErrorResult from the service account JSON configured
+// for the Android app. It is a no-op when Android is configured for the
+// legacy API key instead.
+func InitFCMv1Client() error {
+	if !PushConf.Android.Enabled || PushConf.Android.CredentialsJSON == "" {
+		return nil
+	}
+
+	key, err := ioutil.ReadFile(PushConf.Android.CredentialsJSON)
+	if err != nil {
+		LogError.Error("FCM v1 credentials error:", err.Error())
+
+		return err
+	}
+
+	conf, err := google.JWTConfigFromJSON(key, fcmV1Scope)
+	if err != nil {
+		LogError.Error("FCM v1 credentials error:", err.Error())
+
+		return err
+	}
+
+	fcmV1TokenSource = conf.TokenSource(context.Background())
+
+	return nil
+}
+
+// fcmV1Message is the https://fcm.googleapis.com/v1/projects/{project}/messages:send request body.
+type fcmV1Message struct {
+	Message fcmV1MessageBody `json:"message"`
+}
+
+type fcmV1MessageBody struct {
+	Token        string              `json:"token,omitempty"`
+	Topic        string              `json:"topic,omitempty"`
+	Condition    string              `json:"condition,omitempty"`
+	Data         map[string]string   `json:"data,omitempty"`
+	Notification *fcmV1Notification  `json:"notification,omitempty"`
+	Android      *fcmV1AndroidConfig `json:"android,omitempty"`
+	APNS         *fcmV1APNSConfig    `json:"apns,omitempty"`
+	Webpush      *fcmV1WebpushConfig `json:"webpush,omitempty"`
+}
+
+type fcmV1Notification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+type fcmV1AndroidConfig struct {
+	CollapseKey           string              `json:"collapse_key,omitempty"`
+	Priority              string              `json:"priority,omitempty"`
+	TTL                   string              `json:"ttl,omitempty"`
+	RestrictedPackageName string              `json:"restricted_package_name,omitempty"`
+	Notification          *fcmV1Notification  `json:"notification,omitempty"`
+}
+
+type fcmV1APNSConfig struct {
+	Payload map[string]interface{} `json:"payload,omitempty"`
+}
+
+type fcmV1WebpushConfig struct {
+	Notification *fcmV1Notification `json:"notification,omitempty"`
+}
+
+// fcmV1ErrorResponse mirrors the subset of the v1 error envelope gorush
+// cares about. ref: https://cloud.google.com/apis/design/errors
+type fcmV1ErrorResponse struct {
+	Error struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// fcmV1ReasonToGoogleReason maps the FCM v1 error status onto gorush's
+// existing Reason* constants, so callers don't need to learn a second set
+// of error codes for the new backend.
+var fcmV1ReasonToGoogleReason = map[string]string{
+	"UNREGISTERED":           ReasonNotRegistered,
+	"INVALID_ARGUMENT":       ReasonInvalidRegistration,
+	"QUOTA_EXCEEDED":         ReasonDeviceMessageRateExceeded,
+	"UNAVAILABLE":            ReasonUnavailable,
+	"INTERNAL":               ReasonInternalServerError,
+	"SENDER_ID_MISMATCH":     ReasonMismatchSenderId,
+	"THIRD_PARTY_AUTH_ERROR": ReasonThirdPartyAuthError,
+}
+
+// fcmV1Retryable is the set of v1 error statuses gorush retries with
+// backoff; every other status is a permanent per-token failure.
+var fcmV1Retryable = map[string]bool{
+	"UNAVAILABLE": true,
+	"INTERNAL":    true,
+}
+
+// newFCMv1Message builds the v1 request body for a single token, topic or
+// condition target, reusing the same request fields GetAndroidNotification
+// does for the legacy payload. An empty target means this is a topic/
+// condition send rather than a per-device one.
+func newFCMv1Message(req PushNotification, target string) fcmV1Message {
+	body := fcmV1MessageBody{Token: target}
+
+	if target == "" {
+		switch {
+		case len(req.Condition) > 0:
+			body.Condition = req.Condition
+		case len(req.To) > 0:
+			body.Topic = req.To
+		}
+	}
+
+	if len(req.Message) > 0 || len(req.Title) > 0 {
+		body.Notification = &fcmV1Notification{
+			Title: req.Title,
+			Body:  req.Message,
+		}
+	}
+
+	if len(req.Data) > 0 {
+		body.Data = make(map[string]string, len(req.Data))
+		for k, v := range req.Data {
+			body.Data[k] = fmt.Sprintf("%v", v)
+		}
+	}
+
+	android := &fcmV1AndroidConfig{
+		CollapseKey:           req.CollapseKey,
+		RestrictedPackageName: req.RestrictedPackageName,
+	}
+
+	if req.Priority == "high" {
+		android.Priority = "high"
+	}
+
+	if req.TimeToLive != nil {
+		android.TTL = fmt.Sprintf("%ds", *req.TimeToLive)
+	}
+
+	body.Android = android
+
+	return fcmV1Message{Message: body}
+}
+
+// pushFCMv1Once sends a single v1 message and classifies the result. A nil
+// *GoogleResponse means the token was accepted; a non-nil one carries the
+// mapped Reason and whether it's worth retrying.
+func pushFCMv1Once(target string, req PushNotification) (response *GoogleResponse, retryable bool, retryAfter time.Duration, err error) {
+	endpoint := fmt.Sprintf("https://fcm.googleapis.com/v1/projects/%s/messages:send", PushConf.Android.ProjectID)
+
+	payload, err := json.Marshal(newFCMv1Message(req, target))
+	if err != nil {
+		return nil, false, 0, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, false, 0, err
+	}
+
+	accessToken, err := fcmV1TokenSource.Token()
+	if err != nil {
+		return nil, false, 0, err
+	}
+
+	httpReq.Header.Set("Authorization", "Bearer "+accessToken.AccessToken)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil, false, 0, nil
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	var fcmErr fcmV1ErrorResponse
+	_ = json.Unmarshal(body, &fcmErr)
+
+	reason := fcmV1ReasonToGoogleReason[fcmErr.Error.Status]
+	if reason == "" {
+		reason = ReasonInternalServerError
+	}
+
+	return &GoogleResponse{Reason: reason}, fcmV1Retryable[fcmErr.Error.Status], parseRetryAfter(resp.Header.Get("Retry-After")), nil
+}
+
+// parseRetryAfter reads a Retry-After header expressed in seconds. A
+// missing or unparsable header returns zero, telling the caller to fall
+// back to its own backoff schedule.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	seconds, err := strconv.Atoi(header)
+	if err != nil {
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// pushFCMv1WithRetry sends a single token through FCM v1, retrying
+// UNAVAILABLE/INTERNAL responses with exponential backoff (honoring
+// Retry-After when the server sends one) up to Android.MaxRetry, the same
+// retry budget the legacy path honors. attempts is how many times
+// pushFCMv1Once was actually called, for callers that report it upstream
+// (e.g. the webhook callback).
+func pushFCMv1WithRetry(target string, req PushNotification) (response *GoogleResponse, failed bool, attempts int) {
+	maxRetry := PushConf.Android.MaxRetry
+	if req.Retry > 0 && req.Retry < maxRetry {
+		maxRetry = req.Retry
+	}
+
+	backoff := fcmV1InitialBackoff
+
+	for attempt := 0; ; attempt++ {
+		resp, retryable, wait, err := pushFCMv1Once(target, req)
+		if err != nil {
+			return &GoogleResponse{Reason: ReasonInternalServerError}, true, attempt + 1
+		}
+
+		if resp == nil {
+			return nil, false, attempt + 1
+		}
+
+		if !retryable || attempt >= maxRetry {
+			return resp, true, attempt + 1
+		}
+
+		if wait <= 0 {
+			wait = backoff
+		}
+		backoff *= 2
+
+		time.Sleep(wait)
+	}
+}
+
+// PushToAndroidV1WithErrorResult sends req through FCM HTTP v1, fanning the
+// tokens out to a bounded pool of workers since v1 only accepts one token
+// per call, and aggregates a GoogleResponse per failed token the same way
+// PushToAndroidWithErrorResult does for the legacy API.
+func PushToAndroidV1WithErrorResult(req PushNotification) (*map[string]*GoogleResponse, bool) {
+	LogAccess.Debug("Start push notification for Android (FCM v1)")
+
+	returnResultList := make(map[string]*GoogleResponse)
+
+	// A topic or condition send addresses no individual device, so it has
+	// no Tokens to fan out over; handle it as a single message and skip
+	// CheckMessage, whose tokens-required rule only makes sense for the
+	// per-token path below. Its TimeToLive range check is skipped with it.
+	if len(req.Tokens) == 0 && (len(req.To) > 0 || len(req.Condition) > 0) {
+		return pushFCMv1Target(req)
+	}
+
+	if err := CheckMessage(req); err != nil {
+		LogError.Error("request error: " + err.Error())
+		return &returnResultList, true
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var isError bool
+	maxAttempts := 1
+
+	sem := make(chan struct{}, fcmV1MaxConcurrency)
+
+	for _, target := range req.Tokens {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(target string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			resp, failed, attempts := pushFCMv1WithRetry(target, req)
+
+			mu.Lock()
+			if attempts > maxAttempts {
+				maxAttempts = attempts
+			}
+			mu.Unlock()
+
+			if !failed {
+				LogPush(SucceededPush, target, req, nil)
+				StatStorage.AddAndroidSuccess(1)
+				return
+			}
+
+			LogPush(FailedPush, target, req, errors.New(resp.Reason))
+			StatStorage.AddAndroidError(1)
+
+			mu.Lock()
+			returnResultList[target] = resp
+			isError = true
+			mu.Unlock()
+		}(target)
+	}
+
+	wg.Wait()
+
+	enqueueCallback(req, req.Tokens, maxAttempts, androidResultsToReasons(returnResultList))
+
+	return &returnResultList, isError
+}
+
+// pushFCMv1Target sends a single topic or condition message (no per-device
+// token), the targets FCM v1 supports alongside Tokens. It's keyed in the
+// result map by the topic/condition string itself, same as a device token
+// would key a per-device failure.
+func pushFCMv1Target(req PushNotification) (*map[string]*GoogleResponse, bool) {
+	target := req.To
+	if len(req.Condition) > 0 {
+		target = req.Condition
+	}
+
+	returnResultList := make(map[string]*GoogleResponse)
+
+	resp, failed, attempts := pushFCMv1WithRetry("", req)
+	if failed {
+		LogPush(FailedPush, target, req, errors.New(resp.Reason))
+		StatStorage.AddAndroidError(1)
+		returnResultList[target] = resp
+	} else {
+		LogPush(SucceededPush, target, req, nil)
+		StatStorage.AddAndroidSuccess(1)
+	}
+
+	enqueueCallback(req, []string{target}, attempts, androidResultsToReasons(returnResultList))
+
+	return &returnResultList, failed
+}
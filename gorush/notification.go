@@ -6,12 +6,43 @@ import (
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/google/go-gcm"
 	apns "github.com/sideshow/apns2"
 	"github.com/sideshow/apns2/certificate"
 	"github.com/sideshow/apns2/payload"
+	"github.com/sideshow/apns2/token"
+)
+
+// APNSPusher is satisfied by any client gorush can push iOS notifications
+// through, whether it authenticates with a certificate or a JWT signed with
+// a .p8 token key. Keeping PushToIOSWithErrorResult against this interface
+// instead of the concrete *apns2.Client lets both backends plug in
+// transparently.
+type APNSPusher interface {
+	Push(n *apns.Notification) (*apns.Response, error)
+}
+
+// apnsTokenClientEntry is a cached per-bundle-ID token client along with
+// the key/team IDs it was built from, so a key rotation (a request
+// showing up with a different KeyID/TeamID for a bundle ID we've already
+// cached) rebuilds the client instead of returning a stale one forever.
+type apnsTokenClientEntry struct {
+	client  APNSPusher
+	keyID   string
+	teamID  string
+	keyPath string
+}
+
+// apnsTokenClients caches the per-bundle-ID token clients built for
+// requests that sign in as a different app than the one ApnsClient was
+// configured for. InitWorkers runs workerNum goroutines that can all hit
+// this cache concurrently, so access is guarded by apnsTokenClientsMu.
+var (
+	apnsTokenClientsMu sync.Mutex
+	apnsTokenClients   = map[string]apnsTokenClientEntry{}
 )
 
 // D provide string array
@@ -53,15 +84,16 @@ type RequestPush struct {
 // PushNotification is single notification request
 type PushNotification struct {
 	// Common
-	Tokens           []string `json:"tokens" binding:"required"`
-	Platform         int      `json:"platform" binding:"required"`
-	Message          string   `json:"message,omitempty"`
-	Title            string   `json:"title,omitempty"`
-	Priority         string   `json:"priority,omitempty"`
-	ContentAvailable bool     `json:"content_available,omitempty"`
-	Sound            string   `json:"sound,omitempty"`
-	Data             D        `json:"data,omitempty"`
-	Retry            int      `json:"retry,omitempty"`
+	Tokens           []string  `json:"tokens" binding:"required"`
+	Platform         int       `json:"platform" binding:"required"`
+	Message          string    `json:"message,omitempty"`
+	Title            string    `json:"title,omitempty"`
+	Priority         string    `json:"priority,omitempty"`
+	ContentAvailable bool      `json:"content_available,omitempty"`
+	Sound            string    `json:"sound,omitempty"`
+	Data             D         `json:"data,omitempty"`
+	Retry            int       `json:"retry,omitempty"`
+	Callback         *Callback `json:"callback,omitempty"`
 
 	// Android
 	APIKey                string           `json:"api_key,omitempty"`
@@ -72,6 +104,7 @@ type PushNotification struct {
 	RestrictedPackageName string           `json:"restricted_package_name,omitempty"`
 	DryRun                bool             `json:"dry_run,omitempty"`
 	Notification          gcm.Notification `json:"notification,omitempty"`
+	Condition             string           `json:"condition,omitempty"`
 
 	// iOS
 	Expiration int64    `json:"expiration,omitempty"`
@@ -81,6 +114,17 @@ type PushNotification struct {
 	Category   string   `json:"category,omitempty"`
 	URLArgs    []string `json:"url-args,omitempty"`
 	Alert      Alert    `json:"alert,omitempty"`
+
+	// Token authentication, set these to push through a per-request signer
+	// instead of the certificate configured for the whole iOS app. This
+	// lets a single gorush instance push for multiple apps at once. KeyPath
+	// is optional and falls back to Ios.KeyPath, for the (unusual) case
+	// where every app signs with the same .p8 file but different
+	// team/key/bundle IDs.
+	TeamID   string `json:"team_id,omitempty"`
+	KeyID    string `json:"key_id,omitempty"`
+	BundleID string `json:"bundle_id,omitempty"`
+	KeyPath  string `json:"key_path,omitempty"`
 }
 
 
@@ -146,6 +190,11 @@ const (
 	//A message targeted to an iOS device could not be sent because the required APNs SSL certificate was not
 	//uploaded or has expired. Check the validity of your development and production certificates.
 	ReasonInvalidApnsCredential = "InvalidApnsCredential"
+
+	//FCM HTTP v1 rejected the request because the credentials used to send it
+	//(an OAuth2 access token minted from a service-account key) failed
+	//authentication with the underlying APNs/FCM provider.
+	ReasonThirdPartyAuthError = "ThirdPartyAuthError"
 )
 
 // Response represents a result from the APNs gateway indicating whether a
@@ -221,7 +270,7 @@ func CheckPushConf() error {
 	}
 
 	if PushConf.Android.Enabled {
-		if PushConf.Android.APIKey == "" {
+		if PushConf.Android.APIKey == "" && PushConf.Android.CredentialsJSON == "" && PushConf.Android.ProjectID == "" {
 			return errors.New("Missing Android API Key")
 		}
 	}
@@ -229,59 +278,115 @@ func CheckPushConf() error {
 	return nil
 }
 
-// InitAPNSClient use for initialize APNs Client.
+// InitAPNSClient use for initialize APNs Client. It supports both
+// certificate-based (.p12/.pem) and token-based (.p8) authentication,
+// selected by the extension of Ios.KeyPath. A token client refreshes its
+// JWT automatically, so it never needs to be rebuilt once constructed.
 func InitAPNSClient() error {
 	if PushConf.Ios.Enabled {
-		var err error
 		ext := filepath.Ext(PushConf.Ios.KeyPath)
 
 		switch ext {
-		case ".p12":
-			CertificatePemIos, err = certificate.FromP12File(PushConf.Ios.KeyPath, PushConf.Ios.Password)
-		case ".pem":
-			CertificatePemIos, err = certificate.FromPemFile(PushConf.Ios.KeyPath, PushConf.Ios.Password)
-		default:
-			err = errors.New("wrong certificate key extension")
-		}
+		case ".p12", ".pem":
+			var err error
+			if ext == ".p12" {
+				CertificatePemIos, err = certificate.FromP12File(PushConf.Ios.KeyPath, PushConf.Ios.Password)
+			} else {
+				CertificatePemIos, err = certificate.FromPemFile(PushConf.Ios.KeyPath, PushConf.Ios.Password)
+			}
 
-		if err != nil {
-			LogError.Error("Cert Error:", err.Error())
+			if err != nil {
+				LogError.Error("Cert Error:", err.Error())
 
-			return err
-		}
+				return err
+			}
 
-		if PushConf.Ios.Production {
-			ApnsClient = apns.NewClient(CertificatePemIos).Production()
-		} else {
-			ApnsClient = apns.NewClient(CertificatePemIos).Development()
+			if PushConf.Ios.Production {
+				ApnsClient = apns.NewClient(CertificatePemIos).Production()
+			} else {
+				ApnsClient = apns.NewClient(CertificatePemIos).Development()
+			}
+		case ".p8":
+			client, err := newAPNSTokenClient(PushConf.Ios.KeyPath, PushConf.Ios.KeyID, PushConf.Ios.TeamID, PushConf.Ios.Production)
+			if err != nil {
+				LogError.Error("Token Error:", err.Error())
+
+				return err
+			}
+
+			ApnsClient = client
+		default:
+			return errors.New("wrong certificate key extension")
 		}
 	}
 
 	return nil
 }
 
-// InitWorkers for initialize all workers.
-func InitWorkers(workerNum int64, queueNum int64) {
-	LogAccess.Debug("worker number is ", workerNum, ", queue number is ", queueNum)
-	QueueNotification = make(chan PushNotification, queueNum)
-	for i := int64(0); i < workerNum; i++ {
-		go startWorker()
+// newAPNSTokenClient builds an *apns2.Client authenticated with a JWT
+// derived from a .p8 signing key, for use with Apple's token-based
+// provider authentication.
+func newAPNSTokenClient(keyPath, keyID, teamID string, production bool) (*apns.Client, error) {
+	authKey, err := token.AuthKeyFromFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	tok := &token.Token{
+		AuthKey: authKey,
+		KeyID:   keyID,
+		TeamID:  teamID,
+	}
+
+	client := apns.NewTokenClient(tok)
+	if production {
+		client = client.Production()
+	} else {
+		client = client.Development()
 	}
+
+	return client, nil
 }
 
-func startWorker() {
-	for {
-		notification := <-QueueNotification
-		switch notification.Platform {
-		case PlatFormIos:
-			PushToIOS(notification)
-		case PlatFormAndroid:
-			PushToAndroid(notification)
-		}
+// apnsClientFor returns the APNSPusher that should push the given request.
+// A request that carries its own team_id/key_id/bundle_id is signed with a
+// dedicated token client (built lazily and cached), so one gorush instance
+// can push for multiple apps without per-app certificates. The signing key
+// itself comes from req.KeyPath, falling back to the globally configured
+// Ios.KeyPath when the request doesn't set one — so each app's JWT is
+// signed with that app's own .p8 key, not whichever one gorush started
+// with. Requests without team_id/key_id/bundle_id keep using the globally
+// configured ApnsClient.
+func apnsClientFor(req PushNotification) (APNSPusher, error) {
+	if req.TeamID == "" || req.KeyID == "" || req.BundleID == "" {
+		return ApnsClient, nil
+	}
+
+	keyPath := req.KeyPath
+	if keyPath == "" {
+		keyPath = PushConf.Ios.KeyPath
+	}
+
+	apnsTokenClientsMu.Lock()
+	defer apnsTokenClientsMu.Unlock()
+
+	if entry, ok := apnsTokenClients[req.BundleID]; ok && entry.keyID == req.KeyID && entry.teamID == req.TeamID && entry.keyPath == keyPath {
+		return entry.client, nil
+	}
+
+	client, err := newAPNSTokenClient(keyPath, req.KeyID, req.TeamID, PushConf.Ios.Production)
+	if err != nil {
+		return nil, err
 	}
+
+	apnsTokenClients[req.BundleID] = apnsTokenClientEntry{client: client, keyID: req.KeyID, teamID: req.TeamID, keyPath: keyPath}
+
+	return client, nil
 }
 
-// queueNotification add notification to queue list.
+// queueNotification add notification to queue list. The backend (in-memory
+// channel, Redis Streams, NATS JetStream, ...) is whatever InitWorkers set
+// QueueNotification to; this function never changes when the backend does.
 func queueNotification(req RequestPush) int {
 	var count int
 	for _, notification := range req.Notifications {
@@ -295,7 +400,11 @@ func queueNotification(req RequestPush) int {
 				continue
 			}
 		}
-		QueueNotification <- notification
+
+		if err := QueueNotification.Enqueue(notification); err != nil {
+			LogError.Error("queue error: " + err.Error())
+			continue
+		}
 
 		count += len(notification.Tokens)
 	}
@@ -427,6 +536,7 @@ func PushToIOSWithErrorResult(req PushNotification)  (*map[string]*apns.Response
 
 	var retryCount = 0
 	var maxRetry = PushConf.Ios.MaxRetry
+	originalTokens := req.Tokens
 
 	if req.Retry > 0 && req.Retry < maxRetry {
 		maxRetry = req.Retry
@@ -440,18 +550,25 @@ Retry:
 
 	notification := GetIOSNotification(req)
 
-	for _, token := range req.Tokens {
-		notification.DeviceToken = token
+	client, err := apnsClientFor(req)
+	if err != nil {
+		LogError.Error("Token Error:", err.Error())
+
+		return &returnResultList, true
+	}
+
+	for _, deviceToken := range req.Tokens {
+		notification.DeviceToken = deviceToken
 
 		// send ios notification
-		res, err := ApnsClient.Push(notification)
+		res, err := client.Push(notification)
 
 		if err != nil {
 			// apns server error
-			LogPush(FailedPush, token, req, err)
+			LogPush(FailedPush, deviceToken, req, err)
 			StatStorage.AddIosError(1)
-			newTokens = append(newTokens, token)
-			returnResultList[token] = res
+			newTokens = append(newTokens, deviceToken)
+			returnResultList[deviceToken] = res
 			isError = true
 			continue
 		}
@@ -459,16 +576,16 @@ Retry:
 		if res.StatusCode != 200 {
 			// error message:
 			// ref: https://github.com/sideshow/apns2/blob/master/response.go#L14-L65
-			LogPush(FailedPush, token, req, errors.New(res.Reason))
+			LogPush(FailedPush, deviceToken, req, errors.New(res.Reason))
 			StatStorage.AddIosError(1)
-			newTokens = append(newTokens, token)
-			returnResultList[token] = res
+			newTokens = append(newTokens, deviceToken)
+			returnResultList[deviceToken] = res
 			isError = true
 			continue
 		}
 
 		if res.Sent() {
-			LogPush(SucceededPush, token, req, nil)
+			LogPush(SucceededPush, deviceToken, req, nil)
 			StatStorage.AddIosSuccess(1)
 		}
 	}
@@ -481,6 +598,8 @@ Retry:
 		goto Retry
 	}
 
+	enqueueCallback(req, originalTokens, retryCount+1, iosResultsToReasons(originalTokens, returnResultList))
+
 	return &returnResultList,isError
 }
 
@@ -530,12 +649,30 @@ func GetAndroidNotification(req PushNotification) gcm.HttpMessage {
 	return notification
 }
 
+// PushToAndroid provide send notification to Android server. It uses the
+// newer FCM HTTP v1 endpoint when the Android config carries a service
+// account (CredentialsJSON/ProjectID), and falls back to the legacy GCM
+// HTTP API when it carries an APIKey instead.
 func PushToAndroid(req PushNotification) bool {
-	var isError bool
-	_, isError = PushToAndroidWithErrorResult(req)
+	_, isError := pushAndroidWithErrorResult(req)
 	return isError
 }
 
+// pushAndroidWithErrorResult dispatches to whichever Android backend is
+// configured, so callers that need the per-token result map (not just the
+// pass/fail bool PushToAndroid returns) don't have to repeat the useFCMv1
+// check themselves.
+func pushAndroidWithErrorResult(req PushNotification) (*map[string]*GoogleResponse, bool) {
+	if useFCMv1() {
+		return PushToAndroidV1WithErrorResult(req)
+	}
+	return PushToAndroidWithErrorResult(req)
+}
+
+func useFCMv1() bool {
+	return PushConf.Android.CredentialsJSON != "" || PushConf.Android.ProjectID != ""
+}
+
 
 // PushToAndroid provide send notification to Android server.
 func PushToAndroidWithErrorResult(req PushNotification) (*map[string]*GoogleResponse,bool) {
@@ -544,6 +681,7 @@ func PushToAndroidWithErrorResult(req PushNotification) (*map[string]*GoogleResp
 	var APIKey string
 	var retryCount = 0
 	var maxRetry = PushConf.Android.MaxRetry
+	originalTokens := req.Tokens
 
 	if req.Retry > 0 && req.Retry < maxRetry {
 		maxRetry = req.Retry
@@ -607,5 +745,7 @@ Retry:
 		goto Retry
 	}
 
+	enqueueCallback(req, originalTokens, retryCount+1, androidResultsToReasons(returnResultList))
+
 	return &returnResultList,isError
 }
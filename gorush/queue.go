@@ -0,0 +1,210 @@
+package gorush
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	apns "github.com/sideshow/apns2"
+)
+
+// Queue decouples InitWorkers from how queued notifications are actually
+// stored, so gorush can run against an in-memory channel during
+// development and a durable backend (Redis Streams, NATS JetStream) in
+// production without touching queueNotification or the HTTP handler.
+type Queue interface {
+	// Enqueue stores req for later delivery. It should only block on the
+	// backend's own backpressure, never on a worker being available.
+	Enqueue(req PushNotification) error
+
+	// Dequeue blocks until a notification is available or ctx is done. The
+	// returned ack must be called exactly once: ack(nil) on success, or
+	// ack(err) to request redelivery after a transient failure.
+	Dequeue(ctx context.Context) (req PushNotification, ack func(error), err error)
+}
+
+// QueueNotification is the queue workers pull from and queueNotification
+// pushes to. InitWorkers sets it to whichever backend config selects.
+var QueueNotification Queue
+
+// ErrQueueClosed is returned once a queue has stopped accepting work, e.g.
+// during graceful shutdown.
+var ErrQueueClosed = errors.New("queue is closed")
+
+// MemoryQueue is a Queue backed by a buffered Go channel. It matches
+// gorush's original behavior: notifications queued before a crash or
+// restart are lost, and there is no redelivery since nothing durable
+// backs it, so ack is always a no-op.
+type MemoryQueue struct {
+	notifications chan PushNotification
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+// NewMemoryQueue creates a MemoryQueue buffering up to queueNum notifications.
+func NewMemoryQueue(queueNum int64) *MemoryQueue {
+	return &MemoryQueue{
+		notifications: make(chan PushNotification, queueNum),
+		closed:        make(chan struct{}),
+	}
+}
+
+// Enqueue implements Queue.
+func (q *MemoryQueue) Enqueue(req PushNotification) error {
+	select {
+	case <-q.closed:
+		return ErrQueueClosed
+	default:
+	}
+
+	select {
+	case q.notifications <- req:
+		return nil
+	case <-q.closed:
+		return ErrQueueClosed
+	}
+}
+
+// Dequeue implements Queue. Whatever is already buffered drains even after
+// Close, so a graceful shutdown only has to stop new work from coming in.
+func (q *MemoryQueue) Dequeue(ctx context.Context) (PushNotification, func(error), error) {
+	select {
+	case req := <-q.notifications:
+		return req, func(error) {}, nil
+	default:
+	}
+
+	select {
+	case req := <-q.notifications:
+		return req, func(error) {}, nil
+	case <-q.closed:
+		return PushNotification{}, nil, ErrQueueClosed
+	case <-ctx.Done():
+		return PushNotification{}, nil, ctx.Err()
+	}
+}
+
+// Close stops the queue from accepting new work.
+func (q *MemoryQueue) Close() {
+	q.closeOnce.Do(func() { close(q.closed) })
+}
+
+// InitWorkers sets QueueNotification to queue and starts workerNum
+// goroutines pulling from it until ctx is canceled. It returns a
+// WaitGroup callers can use (see Shutdown) to wait for in-flight pushes
+// to finish draining before the process exits.
+func InitWorkers(ctx context.Context, queue Queue, workerNum int64) *sync.WaitGroup {
+	LogAccess.Debug("worker number is ", workerNum)
+	QueueNotification = queue
+
+	var wg sync.WaitGroup
+	for i := int64(0); i < workerNum; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			startWorker(ctx, queue)
+		}()
+	}
+
+	return &wg
+}
+
+// transientAPNsReasons are apns2 Response.Reason values worth redelivering
+// for: the device itself didn't reject the push, the service did. Every
+// other non-empty reason (bad token, bad payload, ...) is permanent and
+// won't succeed on redelivery no matter how many times it's retried.
+var transientAPNsReasons = map[string]bool{
+	"InternalServerError": true,
+	"ServiceUnavailable":  true,
+	"Shutdown":            true,
+	"TooManyRequests":     true,
+}
+
+// transientGoogleReasons are the Reason* values (shared by the legacy GCM
+// path and FCM v1's mapped reasons) worth redelivering for; see
+// transientAPNsReasons for the iOS side of the same distinction.
+var transientGoogleReasons = map[string]bool{
+	ReasonUnavailable:               true,
+	ReasonInternalServerError:       true,
+	ReasonThirdPartyAuthError:       true,
+	ReasonDeviceMessageRateExceeded: true,
+	ReasonTopicsMessageRateExceeded: true,
+}
+
+// startWorker pulls notifications from queue until ctx is canceled or the
+// queue is closed, pushing each one and acking or nacking it so a durable
+// queue knows whether to redeliver. Only a transient per-token failure
+// (the push endpoint itself, not a specific device token, rejected the
+// request) nacks for redelivery; a permanent failure acks like a success,
+// since MaxRetry has already retried it as many times as makes sense.
+func startWorker(ctx context.Context, queue Queue) {
+	for {
+		notification, ack, err := queue.Dequeue(ctx)
+		if err != nil {
+			return
+		}
+
+		if ack == nil {
+			// Dequeue polled and found nothing new; nothing to ack.
+			continue
+		}
+
+		var transient bool
+		switch notification.Platform {
+		case PlatFormIos:
+			results, _ := PushToIOSWithErrorResult(notification)
+			transient = anyTransientAPNsFailure(*results)
+		case PlatFormAndroid:
+			results, _ := pushAndroidWithErrorResult(notification)
+			transient = anyTransientGoogleFailure(*results)
+		}
+
+		if transient {
+			ack(errors.New("transient push failure, redeliver"))
+			continue
+		}
+
+		ack(nil)
+	}
+}
+
+func anyTransientAPNsFailure(results map[string]*apns.Response) bool {
+	for _, res := range results {
+		if res != nil && transientAPNsReasons[res.Reason] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func anyTransientGoogleFailure(results map[string]*GoogleResponse) bool {
+	for _, res := range results {
+		if res != nil && transientGoogleReasons[res.Reason] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Shutdown cancels the workers' context so they stop pulling new work,
+// then waits up to timeout for whatever they're currently pushing to
+// finish before returning, so a restart or deploy doesn't drop in-flight
+// notifications.
+func Shutdown(cancel context.CancelFunc, wg *sync.WaitGroup, timeout time.Duration) {
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		LogError.Error("graceful shutdown timed out waiting for workers to drain")
+	}
+}
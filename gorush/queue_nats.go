@@ -0,0 +1,120 @@
+package gorush
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsStreamName and natsSubject name the JetStream stream gorush appends
+// queued notifications to, and natsDurableName the durable pull consumer
+// every worker shares.
+const (
+	natsStreamName   = "GORUSH"
+	natsSubject      = "gorush.notifications"
+	natsDurableName  = "gorush-workers"
+	natsAckWait      = 30 * time.Second
+	natsMaxDeliver   = 5
+	natsFetchTimeout = 5 * time.Second
+)
+
+// NATSQueue is a Queue backed by a NATS JetStream durable pull consumer,
+// giving at-least-once delivery across restarts and multiple gorush
+// instances. Publish enqueues; Fetch/Ack dequeues and acknowledges, and
+// JetStream itself redelivers anything left un-acked past AckWait, up to
+// MaxDeliver times.
+type NATSQueue struct {
+	js  nats.JetStreamContext
+	sub *nats.Subscription
+}
+
+// NewNATSQueue connects to addr and ensures the stream and durable pull
+// consumer exist, creating them if this is the first gorush instance to
+// use them.
+func NewNATSQueue(addr string) (*NATSQueue, error) {
+	nc, err := nats.Connect(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := js.StreamInfo(natsStreamName); err != nil {
+		if _, err := js.AddStream(&nats.StreamConfig{
+			Name:     natsStreamName,
+			Subjects: []string{natsSubject},
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	sub, err := js.PullSubscribe(natsSubject, natsDurableName, nats.AckWait(natsAckWait), nats.MaxDeliver(natsMaxDeliver))
+	if err != nil {
+		return nil, err
+	}
+
+	return &NATSQueue{js: js, sub: sub}, nil
+}
+
+// Enqueue implements Queue.
+func (q *NATSQueue) Enqueue(req PushNotification) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.js.Publish(natsSubject, payload)
+	return err
+}
+
+// Dequeue implements Queue by fetching one message from the durable pull
+// consumer, re-fetching past each natsFetchTimeout until a message shows
+// up or ctx is done. The returned ack Acks the message on success, or
+// Naks it so JetStream redelivers it sooner than AckWait on transient
+// failures.
+func (q *NATSQueue) Dequeue(ctx context.Context) (PushNotification, func(error), error) {
+	var msg *nats.Msg
+
+	for msg == nil {
+		if err := ctx.Err(); err != nil {
+			return PushNotification{}, nil, err
+		}
+
+		fetchCtx, cancel := context.WithTimeout(ctx, natsFetchTimeout)
+		msgs, err := q.sub.Fetch(1, nats.Context(fetchCtx))
+		cancel()
+
+		if err != nil {
+			if err == nats.ErrTimeout || ctx.Err() != nil {
+				continue
+			}
+			return PushNotification{}, nil, err
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+
+		msg = msgs[0]
+	}
+
+	var req PushNotification
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		msg.Ack()
+		return PushNotification{}, nil, err
+	}
+
+	ack := func(failErr error) {
+		if failErr == nil {
+			msg.Ack()
+			return
+		}
+		msg.Nak()
+	}
+
+	return req, ack, nil
+}
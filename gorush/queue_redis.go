@@ -0,0 +1,228 @@
+package gorush
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redisStreamKey is the Redis Streams key gorush appends queued
+// notifications to.
+const redisStreamKey = "gorush:notifications"
+
+// redisConsumerGroup is the consumer group every gorush worker joins, so
+// XREADGROUP only ever hands a given stream entry to one worker at a time.
+const redisConsumerGroup = "gorush"
+
+// redisClaimMinIdle is how long an entry must sit unacknowledged in
+// another consumer's pending-entries list before reclaimPendingLoop will
+// steal it back, i.e. how long a crashed worker's in-flight work waits
+// before being redelivered.
+const redisClaimMinIdle = 30 * time.Second
+
+// redisMaxDeliver bounds how many times a single entry is handed back out
+// (tracked by Redis' own per-message delivery counter) before next treats
+// it as permanently stuck and dead-letters it, mirroring the NATS
+// backend's MaxDeliver cap.
+const redisMaxDeliver = 5
+
+// RedisQueue is a Queue backed by a Redis Stream with a consumer group,
+// giving at-least-once delivery across restarts and multiple gorush
+// instances: XADD enqueues, XREADGROUP dequeues, and XACK acknowledges.
+// Entries left pending by a crashed worker are reclaimed by a background
+// loop using XAUTOCLAIM.
+type RedisQueue struct {
+	client   *redis.Client
+	consumer string
+}
+
+// NewRedisQueue connects to addr and ensures the consumer group exists,
+// creating the stream if this is the first gorush instance to use it.
+func NewRedisQueue(addr, password string, db int, consumer string) (*RedisQueue, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+
+	ctx := context.Background()
+	if err := client.XGroupCreateMkStream(ctx, redisStreamKey, redisConsumerGroup, "0").Err(); err != nil && err.Error() != "BUSYGROUP Consumer Group name already exists" {
+		return nil, err
+	}
+
+	q := &RedisQueue{client: client, consumer: consumer}
+	go q.reclaimPendingLoop(ctx)
+
+	return q, nil
+}
+
+// Enqueue implements Queue.
+func (q *RedisQueue) Enqueue(req PushNotification) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	return q.client.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: redisStreamKey,
+		Values: map[string]interface{}{"payload": payload},
+	}).Err()
+}
+
+// Dequeue implements Queue by reading one entry for this consumer via
+// XREADGROUP (see claimNext), blocking (re-polling past XREADGROUP's own Block timeout)
+// until a message shows up or ctx is done. The returned ack XACKs the
+// entry on success, or leaves it pending on failure so it's redelivered —
+// callers must only do that for transient failures, since a permanently
+// failing entry is only ever removed by next's redisMaxDeliver dead-letter
+// check, not by giving up after one nack.
+func (q *RedisQueue) Dequeue(ctx context.Context) (PushNotification, func(error), error) {
+	var msg *redis.XMessage
+
+	for msg == nil {
+		if err := ctx.Err(); err != nil {
+			return PushNotification{}, nil, err
+		}
+
+		next, err := q.next(ctx)
+		if err != nil {
+			return PushNotification{}, nil, err
+		}
+
+		msg = next
+	}
+
+	var req PushNotification
+	if err := json.Unmarshal([]byte(msg.Values["payload"].(string)), &req); err != nil {
+		// malformed entry, ack it so it doesn't block the stream forever
+		q.client.XAck(ctx, redisStreamKey, redisConsumerGroup, msg.ID)
+		return PushNotification{}, nil, err
+	}
+
+	ack := func(failErr error) {
+		if failErr == nil {
+			q.client.XAck(context.Background(), redisStreamKey, redisConsumerGroup, msg.ID)
+		}
+		// leaving it un-acked on failure keeps it in this consumer's
+		// pending-entries list, where claimNext picks it up again
+	}
+
+	return req, ack, nil
+}
+
+// next returns the next entry for this consumer to work, skipping (and
+// dead-lettering) anything redisMaxDeliver has already been exceeded for,
+// so one permanently failing entry can't spin a worker forever and starve
+// the rest of the stream.
+func (q *RedisQueue) next(ctx context.Context) (*redis.XMessage, error) {
+	for {
+		msg, err := q.claimNext(ctx)
+		if err != nil || msg == nil {
+			return msg, err
+		}
+
+		count, err := q.deliveryCount(ctx, msg.ID)
+		if err != nil {
+			LogError.Error("redis queue pending count error: " + err.Error())
+			return msg, nil
+		}
+
+		if count <= redisMaxDeliver {
+			return msg, nil
+		}
+
+		LogError.Error("redis queue dead-lettering " + msg.ID + " after " + strconv.FormatInt(count, 10) + " deliveries")
+		q.client.XAck(ctx, redisStreamKey, redisConsumerGroup, msg.ID)
+	}
+}
+
+// deliveryCount reports how many times id has been delivered, via Redis'
+// own XPENDING counter.
+func (q *RedisQueue) deliveryCount(ctx context.Context, id string) (int64, error) {
+	pending, err := q.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: redisStreamKey,
+		Group:  redisConsumerGroup,
+		Start:  id,
+		End:    id,
+		Count:  1,
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+	if len(pending) == 0 {
+		return 0, nil
+	}
+
+	return pending[0].RetryCount, nil
+}
+
+// claimNext reads one entry for this consumer, preferring whatever
+// reclaimPendingLoop has already claimed into our own pending-entries
+// list over brand new stream entries, so reclaimed work from a crashed
+// worker gets redelivered before we pick up fresh pushes.
+func (q *RedisQueue) claimNext(ctx context.Context) (*redis.XMessage, error) {
+	pending, err := q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    redisConsumerGroup,
+		Consumer: q.consumer,
+		Streams:  []string{redisStreamKey, "0"},
+		Count:    1,
+	}).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	if len(pending) > 0 && len(pending[0].Messages) > 0 {
+		return &pending[0].Messages[0], nil
+	}
+
+	streams, err := q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    redisConsumerGroup,
+		Consumer: q.consumer,
+		Streams:  []string{redisStreamKey, ">"},
+		Count:    1,
+		Block:    5 * time.Second,
+	}).Result()
+
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(streams) == 0 || len(streams[0].Messages) == 0 {
+		return nil, nil
+	}
+
+	return &streams[0].Messages[0], nil
+}
+
+// reclaimPendingLoop periodically steals stream entries that have sat in
+// another consumer's pending-entries list longer than redisClaimMinIdle,
+// so a worker that crashed mid-push doesn't lose its in-flight entries.
+func (q *RedisQueue) reclaimPendingLoop(ctx context.Context) {
+	ticker := time.NewTicker(redisClaimMinIdle)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, _, err := q.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+				Stream:   redisStreamKey,
+				Group:    redisConsumerGroup,
+				Consumer: q.consumer,
+				MinIdle:  redisClaimMinIdle,
+				Start:    "0",
+				Count:    100,
+			}).Result()
+
+			if err != nil {
+				LogError.Error("redis queue reclaim error: " + err.Error())
+			}
+		}
+	}
+}